@@ -44,19 +44,32 @@ package manners
 
 import (
 	"crypto/tls"
+	"errors"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
 )
 
+// ErrShutdownTimeout is returned by Serve when ShutdownTimeout elapses
+// before all in-flight requests finish. Any connections still open at
+// that point are force-closed so that Serve can return.
+var ErrShutdownTimeout = errors.New("manners: shutdown timeout exceeded")
+
 // NewWithServer wraps an existing http.Server object and returns a GracefulServer
 // that supports all of the original Server operations.
 func NewWithServer(s *http.Server) *GracefulServer {
 	return &GracefulServer{
-		Server:   s,
-		shutdown: make(chan struct{}),
-		wg:       new(sync.WaitGroup),
+		Server:      s,
+		shutdown:    make(chan struct{}),
+		wg:          new(sync.WaitGroup),
+		EnableHTTP2: true,
 	}
 }
 
@@ -71,21 +84,86 @@ func NewWithServer(s *http.Server) *GracefulServer {
 // It must be initialized by calling NewServer or NewWithServer
 type GracefulServer struct {
 	*http.Server
-	shutdown chan struct{}
-	wg       waitgroup
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	wg           waitgroup
+
+	// ShutdownTimeout bounds how long Serve, once Close has been called,
+	// waits for in-flight requests to finish before forcibly closing any
+	// connections that are still open.
+	// The zero value disables the timeout, preserving the previous
+	// behavior of waiting indefinitely. Set it before calling Serve; to
+	// change it afterwards, including concurrently with Serve, use
+	// CloseWithTimeout instead of assigning this field directly.
+	ShutdownTimeout time.Duration
+
+	// timeoutMu guards shutdownTimeout and timeoutExplicit. Serve seeds
+	// shutdownTimeout from ShutdownTimeout when it starts, but only if
+	// CloseWithTimeout has not already set an explicit value: without that
+	// guard, Serve's seed and a concurrent CloseWithTimeout call race to
+	// write shutdownTimeout, and whichever one loses is silently discarded
+	// regardless of which one happened "last" in real time.
+	timeoutMu       sync.Mutex
+	shutdownTimeout time.Duration
+	timeoutExplicit bool
+
+	// conns tracks live *gracefulConn values so ShutdownTimeout can force
+	// them closed if they outlive the deadline.
+	conns sync.Map
+
+	// EnableHTTP2 turns on HTTP/2 negotiation in ListenAndServeTLS via
+	// golang.org/x/net/http2, matching the default net/http behavior since
+	// Go 1.6. Defaults to true; set to false before calling
+	// ListenAndServeTLS to restrict the server to HTTP/1.1.
+	EnableHTTP2 bool
+
+	// BeforeShutdown, if set, is called by ListenAndServeGracefully after a
+	// shutdown signal is received but before the server stops accepting
+	// new connections, giving callers a chance to flush logs or deregister
+	// from service discovery.
+	BeforeShutdown func()
+
+	// ShutdownInitiated, if set, is called by ListenAndServeGracefully once
+	// Close has been called in response to a shutdown signal.
+	ShutdownInitiated func()
+
+	// ListenerFunc, if set, is used by ListenAndServe and ListenAndServeTLS
+	// instead of net.Listen, letting callers customize the underlying
+	// socket: TCP keep-alive tuning via TCPKeepAliveListener, SO_REUSEPORT
+	// for zero-downtime restarts, or inheriting an already-open file
+	// descriptor from a supervisor via NewInheritedListener.
+	ListenerFunc func(network, addr string) (net.Listener, error)
 
 	// Only used by test code.
 	up chan net.Listener
 }
 
-// Close stops the server from accepting new requets and beings shutting down.
+// Close stops the server from accepting new requets and beings shutting
+// down. It is safe to call more than once, including concurrently with
+// CloseWithTimeout; only the first call has any effect.
 func (s *GracefulServer) Close() {
-	close(s.shutdown)
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+}
+
+// CloseWithTimeout is like Close, but bounds how long Serve will wait for
+// in-flight requests to finish: once d elapses, any connections still
+// tracked by the server are force-closed and Serve returns
+// ErrShutdownTimeout instead of blocking forever. It is safe to call from
+// any goroutine, including concurrently with Serve, and more than once,
+// including concurrently with Close.
+func (s *GracefulServer) CloseWithTimeout(d time.Duration) {
+	s.timeoutMu.Lock()
+	s.shutdownTimeout = d
+	s.timeoutExplicit = true
+	s.timeoutMu.Unlock()
+	s.Close()
 }
 
 // ListenAndServe provides a graceful equivalent of net/http.Serve.ListenAndServe.
 func (s *GracefulServer) ListenAndServe() error {
-	oldListener, err := net.Listen("tcp", s.Addr)
+	oldListener, err := s.listen()("tcp", s.Addr)
 	if err != nil {
 		return err
 	}
@@ -95,6 +173,14 @@ func (s *GracefulServer) ListenAndServe() error {
 	return err
 }
 
+// listen returns ListenerFunc if one has been set, or net.Listen otherwise.
+func (s *GracefulServer) listen() func(network, addr string) (net.Listener, error) {
+	if s.ListenerFunc != nil {
+		return s.ListenerFunc
+	}
+	return net.Listen
+}
+
 // ListenAndServeTLS provides a graceful equivalent of net/http.Serve.ListenAndServeTLS.
 func (s *GracefulServer) ListenAndServeTLS(certFile, keyFile string) error {
 	// direct lift from net/http/server.go
@@ -104,7 +190,17 @@ func (s *GracefulServer) ListenAndServeTLS(certFile, keyFile string) error {
 	}
 	config := &tls.Config{}
 	if s.TLSConfig != nil {
-		*config = *s.TLSConfig
+		config = s.TLSConfig.Clone()
+	}
+
+	if s.EnableHTTP2 {
+		// http2.ConfigureServer sets up s.TLSConfig (creating one if
+		// necessary) with the NextProtos entry and cipher suite
+		// restrictions HTTP/2 requires; fold that into our local copy.
+		if err := http2.ConfigureServer(s.Server, nil); err != nil {
+			return err
+		}
+		config = s.Server.TLSConfig.Clone()
 	}
 	if config.NextProtos == nil {
 		config.NextProtos = []string{"http/1.1"}
@@ -117,7 +213,7 @@ func (s *GracefulServer) ListenAndServeTLS(certFile, keyFile string) error {
 		return err
 	}
 
-	ln, err := net.Listen("tcp", addr)
+	ln, err := s.listen()("tcp", addr)
 	if err != nil {
 		return err
 	}
@@ -137,6 +233,16 @@ func (s *GracefulServer) Serve(listener net.Listener) error {
 		listener = NewListener(listener)
 	}
 
+	// Seed shutdownTimeout from the field now, unless CloseWithTimeout has
+	// already set an explicit value; timeoutMu makes this check-then-set
+	// atomic with respect to CloseWithTimeout, so a concurrent call can
+	// never have its value clobbered by this seed regardless of ordering.
+	s.timeoutMu.Lock()
+	if !s.timeoutExplicit {
+		s.shutdownTimeout = s.ShutdownTimeout
+	}
+	s.timeoutMu.Unlock()
+
 	var closing int32
 
 	go func() {
@@ -152,10 +258,17 @@ func (s *GracefulServer) Serve(listener net.Listener) error {
 		switch newState {
 		case http.StateNew:
 			// New connection -> StateNew
+			s.conns.Store(gconn, struct{}{})
 			s.StartRoutine()
 
 		case http.StateActive:
 			// (StateNew, StateIdle) -> StateActive
+			// HTTP/2 connections multiplex many requests over one conn and
+			// move straight from StateNew to StateActive, never revisiting
+			// StateIdle in between; this branch is a no-op for them, and
+			// they still correctly count as a single in-flight unit of
+			// work that started on StateNew and finishes on StateClosed/
+			// StateHijacked below.
 			if gconn.lastHTTPState == http.StateIdle {
 				// The connection transitioned from idle back to active
 				s.StartRoutine()
@@ -173,6 +286,7 @@ func (s *GracefulServer) Serve(listener net.Listener) error {
 		case http.StateClosed, http.StateHijacked:
 			// (StateNew, StateActive, StateIdle) -> (StateClosed, StateHiJacked)
 			// If the connection was idle we do not need to decrement the counter.
+			s.conns.Delete(gconn)
 			if gconn.lastHTTPState != http.StateIdle {
 				s.FinishRoutine()
 			}
@@ -193,13 +307,41 @@ func (s *GracefulServer) Serve(listener net.Listener) error {
 
 	// This block is reached when the server has received a shut down command.
 	if err == nil {
+		return s.waitForFinish()
+	} else if _, ok := err.(listenerAlreadyClosed); ok {
+		return s.waitForFinish()
+	}
+	return err
+}
+
+// waitForFinish blocks until all in-flight requests have completed. If
+// ShutdownTimeout is set and elapses first, it force-closes any
+// connections still tracked by the server and returns ErrShutdownTimeout.
+func (s *GracefulServer) waitForFinish() error {
+	s.timeoutMu.Lock()
+	timeout := s.shutdownTimeout
+	s.timeoutMu.Unlock()
+	if timeout <= 0 {
 		s.wg.Wait()
 		return nil
-	} else if _, ok := err.(listenerAlreadyClosed); ok {
+	}
+
+	done := make(chan struct{})
+	go func() {
 		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
 		return nil
+	case <-time.After(timeout):
+		s.conns.Range(func(key, _ interface{}) bool {
+			key.(*gracefulConn).Close()
+			return true
+		})
+		return ErrShutdownTimeout
 	}
-	return err
 }
 
 // StartRoutine increments the server's WaitGroup. Use this if a web request starts more
@@ -213,3 +355,120 @@ func (s *GracefulServer) StartRoutine() {
 func (s *GracefulServer) FinishRoutine() {
 	s.wg.Done()
 }
+
+// ListenAndServeGracefully calls ListenAndServe, installing a signal
+// handler for the given signals (SIGINT and SIGTERM if none are given)
+// that begins a graceful shutdown on the first signal received by calling
+// Close, and force-closes any connections still tracked by the server on
+// a second signal, so that handlers blocked on I/O over those connections
+// fail and return. ListenAndServeGracefully still returns only once every
+// in-flight handler has returned (or ShutdownTimeout elapses); a handler
+// that does not return after its connection is closed keeps it waiting.
+// The signal handler is uninstalled before ListenAndServeGracefully
+// returns, and the watcher goroutine exits promptly even if the server is
+// shut down some other way (e.g. a direct call to Close), so repeated use
+// of a GracefulServer in tests does not leak goroutines.
+func (s *GracefulServer) ListenAndServeGracefully(signals ...os.Signal) error {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, signals...)
+	defer signal.Stop(sigChan)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-sigChan:
+		case <-done:
+			return
+		}
+
+		if s.BeforeShutdown != nil {
+			s.BeforeShutdown()
+		}
+		s.Close()
+		if s.ShutdownInitiated != nil {
+			s.ShutdownInitiated()
+		}
+
+		select {
+		case <-sigChan:
+			s.conns.Range(func(key, _ interface{}) bool {
+				key.(*gracefulConn).Close()
+				return true
+			})
+		case <-done:
+		}
+	}()
+
+	return s.ListenAndServe()
+}
+
+// DefaultServer is the GracefulServer used by the package-level
+// ListenAndServeGracefully helper.
+var DefaultServer = NewWithServer(new(http.Server))
+
+// ListenAndServeGracefully is a convenience wrapper around
+// GracefulServer.ListenAndServeGracefully using DefaultServer, mirroring
+// the package-level ListenAndServe/ListenAndServeTLS helpers shown in the
+// package doc.
+func ListenAndServeGracefully(addr string, handler http.Handler, signals ...os.Signal) error {
+	DefaultServer.Addr = addr
+	DefaultServer.Handler = handler
+	return DefaultServer.ListenAndServeGracefully(signals...)
+}
+
+// TCPKeepAliveListener wraps a *net.TCPListener, enabling TCP keep-alives
+// on every accepted connection the way net/http's own default listener
+// does. KeepAlivePeriod controls how often probes are sent; the zero
+// value leaves the operating system's default period in place. Assign a
+// GracefulServer's ListenerFunc to one backed by this type to customize
+// keep-alive behavior, e.g.:
+//
+//	s.ListenerFunc = func(network, addr string) (net.Listener, error) {
+//		ln, err := net.Listen(network, addr)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return TCPKeepAliveListener{ln.(*net.TCPListener), 3 * time.Minute}, nil
+//	}
+type TCPKeepAliveListener struct {
+	*net.TCPListener
+	KeepAlivePeriod time.Duration
+}
+
+// Accept implements net.Listener, enabling TCP keep-alives on the
+// accepted connection before returning it.
+func (ln TCPKeepAliveListener) Accept() (net.Conn, error) {
+	tc, err := ln.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	tc.SetKeepAlive(true)
+	if ln.KeepAlivePeriod > 0 {
+		tc.SetKeepAlivePeriod(ln.KeepAlivePeriod)
+	}
+	return tc, nil
+}
+
+// NewInheritedListener wraps an already-open file descriptor as a
+// net.Listener, typically one passed down by a supervisor such as
+// systemd or Einhorn. Called from a closure assigned to a GracefulServer's
+// ListenerFunc (its signature differs from ListenerFunc's, so it cannot be
+// assigned directly), it supports graceful binary upgrades: a parent process
+// forks and execs a new server that inherits the listening socket, and
+// the parent then calls Close to drain its own in-flight requests while
+// the child starts accepting immediately.
+func NewInheritedListener(fd uintptr) (net.Listener, error) {
+	file := os.NewFile(fd, "listener")
+	ln, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}